@@ -0,0 +1,140 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package service
+
+import (
+	"sync"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+const (
+	// logQueueCapacity bounds how many buffered lines a subscriber
+	// can fall behind by before its overflow policy kicks in.
+	logQueueCapacity = 256
+	// logQueueBlockTimeout is how long LogOverflowBlock waits for
+	// room to free up in the buffer before giving up and dropping
+	// the incoming line.
+	logQueueBlockTimeout = 100 * time.Millisecond
+)
+
+// logLine is a single log entry forwarded to a subscriber.
+type logLine struct {
+	level keybase1.LogLevel
+	text  string
+}
+
+// logQueue buffers log lines for a single subscriber and drains them
+// to its UI on a dedicated goroutine. Lines below the subscriber's
+// level are dropped at enqueue time; lines that arrive faster than
+// the UI can drain them are handled according to the subscriber's
+// overflow policy, so a slow consumer can neither stall the forwarder
+// that calls Send nor grow this buffer without bound.
+type logQueue struct {
+	name string
+	ui   *LogUI
+
+	mu     sync.Mutex
+	level  keybase1.LogLevel
+	policy logOverflowPolicy
+
+	lines     chan logLine
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newLogQueue(name string, level keybase1.LogLevel, ui *LogUI, policy logOverflowPolicy) *logQueue {
+	q := &logQueue{
+		name:    name,
+		ui:      ui,
+		level:   level,
+		policy:  policy,
+		lines:   make(chan logLine, logQueueCapacity),
+		closeCh: make(chan struct{}),
+	}
+	go q.drain()
+	return q
+}
+
+// SetLevel changes the minimum level this queue accepts.
+func (q *logQueue) SetLevel(level keybase1.LogLevel) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.level = level
+}
+
+// Send enqueues a log line for this subscriber, applying its minimum
+// level and overflow policy. The forwarder calling Send is never
+// blocked for longer than logQueueBlockTimeout, even under
+// LogOverflowBlock.
+func (q *logQueue) Send(level keybase1.LogLevel, text string) {
+	q.mu.Lock()
+	minLevel, policy := q.level, q.policy
+	q.mu.Unlock()
+	if level < minLevel {
+		return
+	}
+
+	line := logLine{level: level, text: text}
+	select {
+	case q.lines <- line:
+		return
+	default:
+	}
+
+	// The buffer is full; apply the subscriber's overflow policy
+	// rather than blocking the forwarder indefinitely or growing the
+	// buffer without bound.
+	switch policy {
+	case LogOverflowDropNewest:
+		return
+
+	case LogOverflowDropOldest:
+		select {
+		case <-q.lines:
+		default:
+		}
+		select {
+		case q.lines <- line:
+		default:
+			// The drain goroutine raced us and refilled the slot we
+			// just freed; drop this line rather than block.
+		}
+
+	case LogOverflowBlock:
+		timer := time.NewTimer(logQueueBlockTimeout)
+		defer timer.Stop()
+		select {
+		case q.lines <- line:
+		case <-timer.C:
+		case <-q.closeCh:
+		}
+	}
+}
+
+// drain delivers buffered lines to the UI until Close is called.
+func (q *logQueue) drain() {
+	for {
+		select {
+		case line := <-q.lines:
+			q.deliver(line)
+		case <-q.closeCh:
+			return
+		}
+	}
+}
+
+func (q *logQueue) deliver(line logLine) {
+	if q.ui == nil {
+		return
+	}
+	q.ui.LogMessage(line.text)
+}
+
+// Close stops the queue's drain goroutine and unblocks any Send
+// waiting under LogOverflowBlock. It is safe to call more than once.
+func (q *logQueue) Close() {
+	q.closeOnce.Do(func() { close(q.closeCh) })
+}
@@ -4,42 +4,111 @@
 package service
 
 import (
-	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
 )
 
+// logOverflowPolicy controls what a subscriber's logQueue does when
+// entries arrive faster than the subscriber drains them.
+type logOverflowPolicy int
+
+const (
+	// LogOverflowDropOldest discards the oldest buffered entry to
+	// make room for the new one.
+	LogOverflowDropOldest logOverflowPolicy = iota
+	// LogOverflowDropNewest discards the incoming entry, leaving the
+	// existing buffer untouched.
+	LogOverflowDropNewest
+	// LogOverflowBlock waits up to a timeout for the subscriber to
+	// make room, then falls back to dropping the incoming entry.
+	LogOverflowBlock
+)
+
+// logSubscriber is a single named consumer of forwarded log entries,
+// with its own minimum level and overflow policy.
+type logSubscriber struct {
+	name  string
+	queue *logQueue
+}
+
+// logRegister forwards log entries to any number of concurrently
+// registered subscribers, each keyed by name with its own minimum
+// level and overflow policy, so that a slow consumer (e.g. a debug
+// console) can't stall or unboundedly queue up behind a fast one
+// (e.g. a crash-report tail).
 type logRegister struct {
+	sync.Mutex
 	forwarder *logFwd
-	queue     *logQueue
+	subs      map[string]*logSubscriber
 	logger    logger.Logger
 }
 
 func newLogRegister(fwd *logFwd, logger logger.Logger) *logRegister {
 	return &logRegister{
 		forwarder: fwd,
+		subs:      make(map[string]*logSubscriber),
 		logger:    logger,
 	}
 }
 
-func (r *logRegister) RegisterLogger(arg keybase1.RegisterLoggerArg, ui *LogUI) error {
-	if r.queue != nil {
-		return errors.New("logger already registered")
+// RegisterLogger adds a new named subscriber with the given overflow
+// policy. It returns an error if a subscriber with the same name is
+// already registered.
+func (r *logRegister) RegisterLogger(arg keybase1.RegisterLoggerArg, ui *LogUI, policy logOverflowPolicy) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.subs[arg.Name]; ok {
+		return fmt.Errorf("logger already registered: %s", arg.Name)
 	}
 
 	// create a new log queue and add it to the forwarder
-	r.queue = newLogQueue(arg.Name, arg.Level, ui)
-	r.forwarder.Add(r.queue)
+	queue := newLogQueue(arg.Name, arg.Level, ui, policy)
+	r.subs[arg.Name] = &logSubscriber{name: arg.Name, queue: queue}
+	r.forwarder.Add(queue)
 
 	return nil
 }
 
-func (r *logRegister) UnregisterLogger() {
-	if r.queue == nil {
+// UnregisterLogger removes the named subscriber, if any.
+func (r *logRegister) UnregisterLogger(name string) {
+	r.Lock()
+	defer r.Unlock()
+	sub, ok := r.subs[name]
+	if !ok {
 		return
 	}
-	// remove the log queue from the forwarder
-	r.forwarder.Remove(r.queue)
-	r.logger.Debug("Unregistered logger: %s", r.queue)
+	// remove the log queue from the forwarder and stop its drain
+	// goroutine
+	delete(r.subs, name)
+	r.forwarder.Remove(sub.queue)
+	sub.queue.Close()
+	r.logger.Debug("Unregistered logger: %s", sub.queue)
+}
+
+// ListLoggers returns the names of all currently registered
+// subscribers.
+func (r *logRegister) ListLoggers() []string {
+	r.Lock()
+	defer r.Unlock()
+	names := make([]string, 0, len(r.subs))
+	for name := range r.subs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// SetLevel changes the minimum level the named subscriber receives.
+// It returns an error if no subscriber with that name is registered.
+func (r *logRegister) SetLevel(name string, level keybase1.LogLevel) error {
+	r.Lock()
+	defer r.Unlock()
+	sub, ok := r.subs[name]
+	if !ok {
+		return fmt.Errorf("no such logger: %s", name)
+	}
+	sub.queue.SetLevel(level)
+	return nil
 }
@@ -0,0 +1,196 @@
+package libkbfs
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// blockRetrievalCacheEntry is a single entry in a
+// blockRetrievalCache's doubly-linked list.
+type blockRetrievalCacheEntry struct {
+	ptr     BlockPointer
+	block   Block
+	visited bool
+	prev    *blockRetrievalCacheEntry
+	next    *blockRetrievalCacheEntry
+}
+
+// blockRetrievalCacheStats is a point-in-time snapshot of a
+// blockRetrievalCache's size and hit/miss counters.
+type blockRetrievalCacheStats struct {
+	Size   int
+	Hits   uint64
+	Misses uint64
+}
+
+// blockRetrievalCache is a bounded cache of recently-retrieved blocks
+// that sits in front of blockRetrievalQueue, so that repeat Request
+// calls for a block that was fetched recently can be satisfied
+// without ever allocating a blockRetrieval or touching the worker
+// pool.
+//
+// Eviction uses the SIEVE algorithm rather than LRU or ARC: entries
+// live in a doubly-linked list (head is most-recently-inserted, tail
+// is least-recently-inserted) with a single "visited" bit apiece, and
+// a "hand" pointer walks the list backwards from the tail looking for
+// an unvisited entry to evict. This gives O(1) amortized Get/Insert
+// with no per-hit list movement, so cache hits never contend with
+// brq.mtx the way an LRU's move-to-front would.
+type blockRetrievalCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[BlockPointer]*blockRetrievalCacheEntry
+	head     *blockRetrievalCacheEntry
+	tail     *blockRetrievalCacheEntry
+	hand     *blockRetrievalCacheEntry
+
+	hits   uint64
+	misses uint64
+}
+
+func newBlockRetrievalCache(capacity int) *blockRetrievalCache {
+	return &blockRetrievalCache{
+		capacity: capacity,
+		entries:  make(map[BlockPointer]*blockRetrievalCacheEntry),
+	}
+}
+
+// Get returns the cached block for ptr, if any, marking the entry as
+// visited so it survives the next eviction pass.
+func (brc *blockRetrievalCache) Get(ptr BlockPointer) (Block, bool) {
+	brc.lock.Lock()
+	defer brc.lock.Unlock()
+	entry, ok := brc.entries[ptr]
+	if !ok {
+		brc.misses++
+		return nil, false
+	}
+	entry.visited = true
+	brc.hits++
+	return entry.block, true
+}
+
+// Insert adds block to the cache under ptr, evicting an entry via
+// SIEVE if the cache is already at capacity. It is a no-op if ptr is
+// already cached, or if the cache has no capacity.
+func (brc *blockRetrievalCache) Insert(ptr BlockPointer, block Block) {
+	brc.lock.Lock()
+	defer brc.lock.Unlock()
+	if brc.capacity <= 0 {
+		return
+	}
+	if _, ok := brc.entries[ptr]; ok {
+		return
+	}
+	if len(brc.entries) >= brc.capacity {
+		brc.evictLocked()
+	}
+	entry := &blockRetrievalCacheEntry{ptr: ptr, block: cloneBlock(block)}
+	brc.pushFrontLocked(entry)
+	brc.entries[ptr] = entry
+	if brc.hand == nil {
+		brc.hand = brc.tail
+	}
+}
+
+// Stats returns a snapshot of the cache's size and hit/miss counters.
+func (brc *blockRetrievalCache) Stats() blockRetrievalCacheStats {
+	brc.lock.Lock()
+	defer brc.lock.Unlock()
+	return blockRetrievalCacheStats{
+		Size:   len(brc.entries),
+		Hits:   brc.hits,
+		Misses: brc.misses,
+	}
+}
+
+func (brc *blockRetrievalCache) pushFrontLocked(entry *blockRetrievalCacheEntry) {
+	entry.next = brc.head
+	entry.prev = nil
+	if brc.head != nil {
+		brc.head.prev = entry
+	}
+	brc.head = entry
+	if brc.tail == nil {
+		brc.tail = entry
+	}
+}
+
+func (brc *blockRetrievalCache) removeLocked(entry *blockRetrievalCacheEntry) {
+	if entry.prev != nil {
+		entry.prev.next = entry.next
+	} else {
+		brc.head = entry.next
+	}
+	if entry.next != nil {
+		entry.next.prev = entry.prev
+	} else {
+		brc.tail = entry.prev
+	}
+	entry.prev = nil
+	entry.next = nil
+}
+
+// evictLocked walks the hand backwards from its current position
+// (starting at the tail if the hand hasn't been set yet), clearing
+// visited bits as it passes over set ones, until it finds an entry
+// whose visited bit is already clear. That entry is evicted, and the
+// hand is left pointing at its predecessor, wrapping to the tail if
+// the evicted entry was the head. brc.lock must be held.
+func (brc *blockRetrievalCache) evictLocked() {
+	o := brc.hand
+	if o == nil {
+		o = brc.tail
+	}
+	for o != nil && o.visited {
+		o.visited = false
+		o = o.prev
+		if o == nil {
+			o = brc.tail
+		}
+	}
+	if o == nil {
+		return
+	}
+	// Capture the predecessor before removeLocked mutates o's links
+	// (and brc.head/brc.tail). Falling back to brc.tail must also
+	// happen after removeLocked runs, since if o was the only entry,
+	// brc.tail still points at o itself until removeLocked clears it.
+	next := o.prev
+	brc.removeLocked(o)
+	delete(brc.entries, o.ptr)
+	if next == nil {
+		next = brc.tail
+	}
+	brc.hand = next
+}
+
+// copyBlockInto copies the contents of src into dst, which must be a
+// pointer to the same underlying Block type as src. This lets a cache
+// hit in Request satisfy the caller's block argument the same way a
+// worker would have filled it in. It returns an error instead of
+// panicking if dst and src aren't the same concrete pointer type.
+func copyBlockInto(dst, src Block) error {
+	dstVal := reflect.ValueOf(dst)
+	srcVal := reflect.ValueOf(src)
+	if dstVal.Kind() != reflect.Ptr || srcVal.Kind() != reflect.Ptr {
+		return fmt.Errorf("libkbfs: cannot copy block: dst and src must be pointers")
+	}
+	if dstVal.Type() != srcVal.Type() {
+		return fmt.Errorf("libkbfs: cannot copy cached block of type %s into %s",
+			srcVal.Type(), dstVal.Type())
+	}
+	dstVal.Elem().Set(srcVal.Elem())
+	return nil
+}
+
+// cloneBlock makes a shallow copy of block's underlying struct, so
+// that the cache's copy can't be mutated via a pointer the caller
+// holds onto after a successful fetch (e.g. a reused buffer).
+func cloneBlock(block Block) Block {
+	v := reflect.ValueOf(block)
+	clone := reflect.New(v.Elem().Type())
+	clone.Elem().Set(v.Elem())
+	return clone.Interface().(Block)
+}
@@ -0,0 +1,49 @@
+package libkbfs
+
+// blockRetrievalHeap implements heap.Interface for a slice of
+// *blockRetrieval, ordered so that container/heap.Pop always returns
+// the highest-priority retrieval, breaking ties in favor of whichever
+// was inserted first.
+type blockRetrievalHeap []*blockRetrieval
+
+// Len implements heap.Interface for blockRetrievalHeap.
+func (brh blockRetrievalHeap) Len() int { return len(brh) }
+
+// Less implements heap.Interface for blockRetrievalHeap. It orders by
+// effective priority (base priority plus any accrued aging boost)
+// rather than raw priority, so that a retrieval that has been aged
+// can outrank one with a nominally higher priority.
+func (brh blockRetrievalHeap) Less(i, j int) bool {
+	pi, pj := brh[i].effectivePriority(), brh[j].effectivePriority()
+	if pi != pj {
+		// Higher effective priority comes first.
+		return pi > pj
+	}
+	// Older insertions come first within the same effective priority.
+	return brh[i].insertionOrder < brh[j].insertionOrder
+}
+
+// Swap implements heap.Interface for blockRetrievalHeap.
+func (brh blockRetrievalHeap) Swap(i, j int) {
+	brh[i], brh[j] = brh[j], brh[i]
+	brh[i].index = i
+	brh[j].index = j
+}
+
+// Push implements heap.Interface for blockRetrievalHeap.
+func (brh *blockRetrievalHeap) Push(x interface{}) {
+	br := x.(*blockRetrieval)
+	br.index = len(*brh)
+	*brh = append(*brh, br)
+}
+
+// Pop implements heap.Interface for blockRetrievalHeap.
+func (brh *blockRetrievalHeap) Pop() interface{} {
+	old := *brh
+	n := len(old)
+	br := old[n-1]
+	old[n-1] = nil
+	br.index = -1
+	*brh = old[:n-1]
+	return br
+}
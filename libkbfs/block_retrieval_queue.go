@@ -3,18 +3,27 @@ package libkbfs
 import (
 	"container/heap"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
 const (
-	defaultBlockRetrievalWorkerQueueSize int = 100
+	defaultBlockRetrievalWorkerQueueSize int           = 100
+	defaultBlockRetrievalCacheCapacity   int           = 1000
+	defaultBlockRetrievalAgingInterval   time.Duration = 10 * time.Second
+	defaultBlockRetrievalMaxBoost        int           = 5
 )
 
 type blockRetrievalRequest struct {
-	ctx    context.Context
-	block  Block
-	doneCh chan error
+	ctx      context.Context
+	block    Block
+	doneCh   chan error
+	priority int
+	// cancelCh is closed once this request no longer needs to be
+	// watched for context cancellation, either because it was
+	// finalized normally or because it was already cancelled.
+	cancelCh chan struct{}
 }
 
 type blockRetrieval struct {
@@ -22,7 +31,21 @@ type blockRetrieval struct {
 	index          int
 	priority       int
 	insertionOrder uint64
-	requests       []*blockRetrievalRequest
+	insertionTime  time.Time
+	// agingBoost is added to priority when ordering the heap, to
+	// keep low-priority retrievals from starving under sustained
+	// high-priority traffic. It is maintained by
+	// blockRetrievalQueue.ageRequests and is independent of
+	// priority, which can be raised or lowered by requestors coming
+	// and going.
+	agingBoost int
+	requests   []*blockRetrievalRequest
+}
+
+// effectivePriority is priority plus any accrued agingBoost, and is
+// what the heap actually orders by.
+func (br *blockRetrieval) effectivePriority() int {
+	return br.priority + br.agingBoost
 }
 
 type blockRetrievalQueue struct {
@@ -35,14 +58,94 @@ type blockRetrievalQueue struct {
 
 	heap        *blockRetrievalHeap
 	workerQueue chan chan *blockRetrieval
+
+	// cache holds recently-retrieved blocks so that repeat requests
+	// for the same pointer can skip the worker pool entirely.
+	cache *blockRetrievalCache
+
+	// agingInterval and maxBoost control how quickly a queued
+	// retrieval's effective priority rises while it waits, to
+	// prevent starvation under sustained high-priority traffic.
+	agingInterval time.Duration
+	maxBoost      int
+	agingDoneCh   chan struct{}
+
+	// maxQueueWait is the longest any retrieval has waited between
+	// being queued and being finalized or having its last requestor
+	// cancelled, for operators tuning
+	// agingInterval and maxBoost.
+	maxQueueWait time.Duration
 }
 
-func newBlockRetrievalQueue(numWorkers int) *blockRetrievalQueue {
-	return &blockRetrievalQueue{
-		ptrs:        make(map[BlockPointer]*blockRetrieval),
-		heap:        &blockRetrievalHeap{},
-		workerQueue: make(chan chan *blockRetrieval, numWorkers),
+func newBlockRetrievalQueue(
+	numWorkers int, agingInterval time.Duration,
+	maxBoost int) *blockRetrievalQueue {
+	brq := &blockRetrievalQueue{
+		ptrs:          make(map[BlockPointer]*blockRetrieval),
+		heap:          &blockRetrievalHeap{},
+		workerQueue:   make(chan chan *blockRetrieval, numWorkers),
+		cache:         newBlockRetrievalCache(defaultBlockRetrievalCacheCapacity),
+		agingInterval: agingInterval,
+		maxBoost:      maxBoost,
+		agingDoneCh:   make(chan struct{}),
 	}
+	go brq.ageRequests()
+	return brq
+}
+
+// ageRequests periodically recomputes each queued blockRetrieval's
+// agingBoost from how long it's been waiting, fixing up the heap for
+// any entry whose effective priority changed, until Shutdown is
+// called.
+func (brq *blockRetrievalQueue) ageRequests() {
+	if brq.agingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(brq.agingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			brq.ageRequestsOnce()
+		case <-brq.agingDoneCh:
+			return
+		}
+	}
+}
+
+func (brq *blockRetrievalQueue) ageRequestsOnce() {
+	brq.mtx.Lock()
+	defer brq.mtx.Unlock()
+	now := time.Now()
+	// heap.Fix below reorders *brq.heap via Swap, so range over a
+	// snapshot rather than the live slice to avoid skipping or
+	// revisiting entries within this pass.
+	entries := append([]*blockRetrieval(nil), (*brq.heap)...)
+	for _, br := range entries {
+		boost := int(now.Sub(br.insertionTime) / brq.agingInterval)
+		if boost > brq.maxBoost {
+			boost = brq.maxBoost
+		}
+		if boost != br.agingBoost {
+			br.agingBoost = boost
+			heap.Fix(brq.heap, br.index)
+		}
+	}
+}
+
+// Shutdown stops the background aging goroutine. It is safe to call
+// at most once.
+func (brq *blockRetrievalQueue) Shutdown() {
+	close(brq.agingDoneCh)
+}
+
+// MaxQueueWait returns the longest duration any retrieval has spent
+// queued before being finalized or having its last requestor
+// cancelled, for tuning agingInterval and maxBoost.
+func (brq *blockRetrievalQueue) MaxQueueWait() time.Duration {
+	brq.mtx.RLock()
+	defer brq.mtx.RUnlock()
+	return brq.maxQueueWait
 }
 
 func (brq *blockRetrievalQueue) notifyWorker() {
@@ -58,6 +161,19 @@ func (brq *blockRetrievalQueue) notifyWorker() {
 }
 
 func (brq *blockRetrievalQueue) Request(ctx context.Context, priority int, ptr BlockPointer, block Block) <-chan error {
+	// Consult the cache first so a repeat request for a block we
+	// already have never allocates a blockRetrieval or wakes a
+	// worker. If the cached block's type doesn't match the caller's
+	// block argument, fall through to the normal request path rather
+	// than serving a bad copy.
+	if cachedBlock, ok := brq.cache.Get(ptr); ok {
+		if err := copyBlockInto(block, cachedBlock); err == nil {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}
+	}
+
 	brq.mtx.Lock()
 	defer brq.mtx.Unlock()
 	var br *blockRetrieval
@@ -69,6 +185,7 @@ func (brq *blockRetrievalQueue) Request(ctx context.Context, priority int, ptr B
 			index:          -1,
 			priority:       priority,
 			insertionOrder: brq.insertionCount,
+			insertionTime:  time.Now(),
 			requests:       []*blockRetrievalRequest{},
 		}
 		brq.insertionCount++
@@ -77,15 +194,111 @@ func (brq *blockRetrievalQueue) Request(ctx context.Context, priority int, ptr B
 		defer brq.notifyWorker()
 	}
 	ch := make(chan error, 1)
-	br.requests = append(br.requests, &blockRetrievalRequest{ctx, block, ch})
+	brr := &blockRetrievalRequest{
+		ctx:      ctx,
+		block:    block,
+		doneCh:   ch,
+		priority: priority,
+		cancelCh: make(chan struct{}),
+	}
+	br.requests = append(br.requests, brr)
 	// If the new request priority is higher, elevate the request in the queue
 	if priority > br.priority {
 		br.priority = priority
 		heap.Fix(brq.heap, br.index)
 	}
+	go brq.watchForCancel(ctx, ptr, brr)
 	return ch
 }
 
+// watchForCancel waits for either ctx to be done or brr to be
+// finalized (normally or via an earlier cancellation), and in the
+// former case removes brr from the queue.
+func (brq *blockRetrievalQueue) watchForCancel(
+	ctx context.Context, ptr BlockPointer, brr *blockRetrievalRequest) {
+	select {
+	case <-ctx.Done():
+		brq.mtx.Lock()
+		defer brq.mtx.Unlock()
+		brq.cancelRequestLocked(ptr, brr.doneCh, ctx.Err())
+	case <-brr.cancelCh:
+	}
+}
+
+// CancelRequest removes the requestor identified by doneCh from the
+// blockRetrieval for ptr, delivering context.Canceled to it, and
+// cleans up the blockRetrieval entirely if that was the last
+// requestor. Requestors that pass a cancellable ctx to Request get
+// this for free; CancelRequest is for callers that would rather not
+// rely on ctx cancellation.
+func (brq *blockRetrievalQueue) CancelRequest(ptr BlockPointer, doneCh chan error) {
+	brq.mtx.Lock()
+	defer brq.mtx.Unlock()
+	brq.cancelRequestLocked(ptr, doneCh, context.Canceled)
+}
+
+// cancelRequestLocked removes the requestor identified by doneCh from
+// the blockRetrieval for ptr, if any, notifying it with err. If that
+// was the blockRetrieval's last requestor, the blockRetrieval is
+// removed from both brq.ptrs and brq.heap -- via heap.Remove using
+// its tracked index -- provided a worker hasn't already popped it off
+// the heap. If the removed requestor held the blockRetrieval's
+// current priority, the priority is demoted to the max priority still
+// held by a remaining requestor, symmetric to the promotion in
+// Request. brq.mtx must be held for writing.
+func (brq *blockRetrievalQueue) cancelRequestLocked(
+	ptr BlockPointer, doneCh chan error, err error) {
+	br, ok := brq.ptrs[ptr]
+	if !ok {
+		return
+	}
+
+	idx := -1
+	for i, r := range br.requests {
+		if r.doneCh == doneCh {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return
+	}
+	removed := br.requests[idx]
+	br.requests = append(br.requests[:idx:idx], br.requests[idx+1:]...)
+	close(removed.cancelCh)
+
+	select {
+	case doneCh <- err:
+	default:
+	}
+
+	if len(br.requests) == 0 {
+		delete(brq.ptrs, ptr)
+		if br.index != -1 {
+			heap.Remove(brq.heap, br.index)
+		}
+		if wait := time.Since(br.insertionTime); wait > brq.maxQueueWait {
+			brq.maxQueueWait = wait
+		}
+		return
+	}
+
+	if removed.priority == br.priority {
+		maxPriority := br.requests[0].priority
+		for _, r := range br.requests[1:] {
+			if r.priority > maxPriority {
+				maxPriority = r.priority
+			}
+		}
+		if maxPriority != br.priority {
+			br.priority = maxPriority
+			if br.index != -1 {
+				heap.Fix(brq.heap, br.index)
+			}
+		}
+	}
+}
+
 func (brq *blockRetrievalQueue) WorkOnRequest() <-chan *blockRetrieval {
 	ch := make(chan *blockRetrieval, 1)
 	brq.workerQueue <- ch
@@ -96,10 +309,29 @@ func (brq *blockRetrievalQueue) WorkOnRequest() <-chan *blockRetrieval {
 // FinalizeRequest communicates that any subsequent requestors for this block
 // won't be notified by the current worker processing it.  This must be called
 // before sending out the responses to the blockRetrievalRequests for a given
-// blockRetrieval.
-func (brq *blockRetrievalQueue) FinalizeRequest(ptr BlockPointer) {
+// blockRetrieval. On success, it also populates the cache so that
+// subsequent Request calls for ptr can be served without involving the
+// worker pool.
+func (brq *blockRetrievalQueue) FinalizeRequest(ptr BlockPointer, block Block, err error) {
 	brq.mtx.Lock()
 	defer brq.mtx.Unlock()
 
+	if br, ok := brq.ptrs[ptr]; ok {
+		for _, r := range br.requests {
+			close(r.cancelCh)
+		}
+		if wait := time.Since(br.insertionTime); wait > brq.maxQueueWait {
+			brq.maxQueueWait = wait
+		}
+	}
 	delete(brq.ptrs, ptr)
+	if err == nil {
+		brq.cache.Insert(ptr, block)
+	}
+}
+
+// CacheStats returns the size and hit/miss counters of the cache
+// fronting this queue, for monitoring and tuning.
+func (brq *blockRetrievalQueue) CacheStats() blockRetrievalCacheStats {
+	return brq.cache.Stats()
 }
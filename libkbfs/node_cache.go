@@ -1,12 +1,51 @@
 package libkbfs
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
 
 type nodeCacheEntry struct {
 	node     *nodeStandard
 	refCount int
 }
 
+// nodeCacheMode describes the lifecycle state of a nodeCacheStandard.
+type nodeCacheMode int
+
+const (
+	// NodeCacheActive is the normal operating mode: all operations
+	// are allowed.
+	NodeCacheActive nodeCacheMode = iota
+	// NodeCacheReadOnly rejects mutating operations (GetOrCreate,
+	// Move, Unlink) but otherwise leaves in-flight reads alone.
+	NodeCacheReadOnly
+	// NodeCacheDraining rejects mutating operations and cancels the
+	// context returned by Context, to let the cache quiesce before
+	// being torn down. It's up to callers that start work on behalf
+	// of this cache's nodes (e.g. a blockRetrievalQueue.Request) to
+	// have derived their context from Context in the first place for
+	// this to have any effect on them.
+	NodeCacheDraining
+	// NodeCacheClosed is a terminal mode; the cache should no longer
+	// be used for anything.
+	NodeCacheClosed
+)
+
+// NodeCacheNotActiveError indicates that an operation was rejected
+// because its nodeCacheStandard is not in NodeCacheActive mode.
+type NodeCacheNotActiveError struct {
+	TlfID TlfID
+	Mode  nodeCacheMode
+}
+
+func (e NodeCacheNotActiveError) Error() string {
+	return fmt.Sprintf("Node cache for %s is not active (mode=%d)",
+		e.TlfID, e.Mode)
+}
+
 // nodeCacheStandard implements the NodeCache interface by tracking
 // the reference counts of nodeStandard Nodes, and using their member
 // fields to construct paths.
@@ -15,18 +54,104 @@ type nodeCacheStandard struct {
 	branch BranchName
 	nodes  map[BlockPointer]*nodeCacheEntry
 	lock   sync.RWMutex
+
+	modeLock sync.RWMutex
+	mode     nodeCacheMode
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
 var _ NodeCache = (*nodeCacheStandard)(nil)
 
 func newNodeCacheStandard(id TlfID, branch BranchName) *nodeCacheStandard {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &nodeCacheStandard{
 		id:     id,
 		branch: branch,
 		nodes:  make(map[BlockPointer]*nodeCacheEntry),
+		mode:   NodeCacheActive,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
+// SetMode transitions the cache to mode. Moving to NodeCacheDraining
+// or NodeCacheClosed cancels the context returned by Context; moving
+// to NodeCacheActive replaces it with a fresh one for subsequent
+// operations if it was cancelled, and otherwise keeps it, so that
+// requests started before a NodeCacheReadOnly spell are still
+// cancelled by a later move to NodeCacheDraining or NodeCacheClosed. NodeCacheReadOnly only affects GetOrCreate/Move/Unlink
+// (see checkActive) and leaves ctx alone, since it promises to leave
+// in-flight reads alone. SetMode itself doesn't touch any in-flight
+// work -- it's up to callers to have derived their operation's
+// context from Context (see its doc comment) for this cancellation to
+// reach them.
+func (ncs *nodeCacheStandard) SetMode(mode nodeCacheMode) {
+	ncs.modeLock.Lock()
+	defer ncs.modeLock.Unlock()
+	if ncs.mode == mode {
+		return
+	}
+	ncs.mode = mode
+	switch mode {
+	case NodeCacheActive:
+		if ncs.ctx.Err() != nil {
+			ncs.ctx, ncs.cancel = context.WithCancel(context.Background())
+		}
+	case NodeCacheDraining, NodeCacheClosed:
+		ncs.cancel()
+	}
+}
+
+// Mode returns the cache's current lifecycle mode.
+func (ncs *nodeCacheStandard) Mode() nodeCacheMode {
+	ncs.modeLock.RLock()
+	defer ncs.modeLock.RUnlock()
+	return ncs.mode
+}
+
+// Context returns the context this cache currently considers live.
+// It's cancelled when the cache moves to NodeCacheDraining or
+// NodeCacheClosed. RequestBlock derives its requests' contexts from
+// this one; other work done on behalf of this cache's nodes should do
+// the same to be cancelled along with it.
+func (ncs *nodeCacheStandard) Context() context.Context {
+	ncs.modeLock.RLock()
+	defer ncs.modeLock.RUnlock()
+	return ncs.ctx
+}
+
+// RequestBlock calls brq.Request on behalf of a node owned by this
+// cache, merging ctx with the cache's own Context() so that the
+// request is cancelled not only by the caller's ctx but also if this
+// cache moves to NodeCacheDraining or NodeCacheClosed while the
+// request is outstanding.
+func (ncs *nodeCacheStandard) RequestBlock(
+	ctx context.Context, brq *blockRetrievalQueue, priority int,
+	ptr BlockPointer, block Block) <-chan error {
+	cacheCtx := ncs.Context()
+	mergedCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-cacheCtx.Done():
+			cancel()
+		case <-mergedCtx.Done():
+		}
+	}()
+	return brq.Request(mergedCtx, priority, ptr, block)
+}
+
+// checkActive returns NodeCacheNotActiveError if the cache is not in
+// NodeCacheActive mode.
+func (ncs *nodeCacheStandard) checkActive() error {
+	ncs.modeLock.RLock()
+	defer ncs.modeLock.RUnlock()
+	if ncs.mode != NodeCacheActive {
+		return NodeCacheNotActiveError{TlfID: ncs.id, Mode: ncs.mode}
+	}
+	return nil
+}
+
 // lock must be locked for writing by the caller
 func (ncs *nodeCacheStandard) forgetLocked(node Node) {
 	nodeStandard, ok := node.(*nodeStandard)
@@ -78,6 +203,10 @@ func (ncs *nodeCacheStandard) newChildForParentLocked(parent Node) error {
 // GetOrCreate implements the NodeCache interface for nodeCacheStandard.
 func (ncs *nodeCacheStandard) GetOrCreate(
 	ptr BlockPointer, name string, parent Node) (Node, error) {
+	if err := ncs.checkActive(); err != nil {
+		return nil, err
+	}
+
 	ncs.lock.RLock()
 	entry, ok := ncs.nodes[ptr]
 	if ok {
@@ -141,6 +270,10 @@ func (ncs *nodeCacheStandard) UpdatePointer(
 // Move implements the NodeCache interface for nodeCacheStandard.
 func (ncs *nodeCacheStandard) Move(
 	ptr BlockPointer, newParent Node, newName string) error {
+	if err := ncs.checkActive(); err != nil {
+		return err
+	}
+
 	ncs.lock.Lock()
 	defer ncs.lock.Unlock()
 	entry, ok := ncs.nodes[ptr]
@@ -163,7 +296,14 @@ func (ncs *nodeCacheStandard) Move(
 }
 
 // Unlink implements the NodeCache interface for nodeCacheStandard.
+// Unlink's signature has no error return, so in a non-Active mode it
+// silently does nothing rather than rejecting with
+// NodeCacheNotActiveError.
 func (ncs *nodeCacheStandard) Unlink(ptr BlockPointer, oldPath path) {
+	if ncs.checkActive() != nil {
+		return
+	}
+
 	ncs.lock.Lock()
 	defer ncs.lock.Unlock()
 	entry, ok := ncs.nodes[ptr]
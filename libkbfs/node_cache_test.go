@@ -0,0 +1,64 @@
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testBlock is a minimal stand-in for a real Block implementation;
+// this test never inspects its contents, it only needs something to
+// hand to RequestBlock.
+type testBlock struct {
+	n int
+}
+
+// TestNodeCacheStandardSetModeCancelsInFlightRequest verifies that a
+// blockRetrievalQueue.Request issued through RequestBlock is
+// cancelled promptly when the owning cache transitions out of
+// NodeCacheActive mid-request, even though the caller's own context
+// is never cancelled.
+func TestNodeCacheStandardSetModeCancelsInFlightRequest(t *testing.T) {
+	ncs := newNodeCacheStandard(TlfID{}, BranchName(""))
+	brq := newBlockRetrievalQueue(0, 0, 0)
+	defer brq.Shutdown()
+
+	var ptr BlockPointer
+	doneCh := ncs.RequestBlock(
+		context.Background(), brq, 1, ptr, &testBlock{})
+
+	ncs.SetMode(NodeCacheDraining)
+
+	select {
+	case err := <-doneCh:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("worker did not observe cancellation promptly")
+	}
+}
+
+// TestNodeCacheStandardReadOnlyDoesNotCancel verifies that moving to
+// NodeCacheReadOnly leaves an in-flight RequestBlock call alone,
+// since NodeCacheReadOnly only promises to reject new mutations.
+func TestNodeCacheStandardReadOnlyDoesNotCancel(t *testing.T) {
+	ncs := newNodeCacheStandard(TlfID{}, BranchName(""))
+	brq := newBlockRetrievalQueue(0, 0, 0)
+	defer brq.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // clean up the still-outstanding request
+
+	var ptr BlockPointer
+	doneCh := ncs.RequestBlock(ctx, brq, 1, ptr, &testBlock{})
+
+	ncs.SetMode(NodeCacheReadOnly)
+
+	select {
+	case err := <-doneCh:
+		t.Fatalf("request was cancelled on ReadOnly transition: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}